@@ -0,0 +1,67 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/cmd/agent/app"
+	"sigs.k8s.io/apiserver-network-proxy/cmd/agent/app/options"
+)
+
+func main() {
+	klog.InitFlags(nil)
+	o := options.NewGrpcProxyAgentOptions()
+	command := newAgentCommand(app.NewAgentServer(o), o)
+	if err := command.Execute(); err != nil {
+		klog.Exit(err)
+	}
+}
+
+func newAgentCommand(s *app.AgentServer, o *options.GrpcProxyAgentOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:  "proxy-agent",
+		Long: "The agent connects to one or more instances of the proxy-server and proxies traffic from them to the cluster it runs in.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stopCh := setupSignalHandler()
+			return s.Run(cmd.Flags(), stopCh)
+		},
+	}
+	flags := cmd.Flags()
+	flags.AddFlagSet(o.Flags())
+	return cmd
+}
+
+// setupSignalHandler returns a channel that is closed on SIGTERM/SIGINT so
+// Run can shut down gracefully instead of being killed mid-flight.
+func setupSignalHandler() <-chan struct{} {
+	stopCh := make(chan struct{})
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		close(stopCh)
+		<-sigCh
+		os.Exit(1)
+	}()
+	return stopCh
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/cmd/agent/app/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/cmd/agent/app/options"
+)
+
+// serveAdmin starts the admin server (pprof, if enabled) and, unless a
+// dedicated metrics listener is requested, the /metrics endpoint as well.
+// It returns once both listeners are up; each listener serves on its own
+// goroutine for the lifetime of the process.
+func serveAdmin(o *options.GrpcProxyAgentOptions, m *metrics.Metrics) error {
+	adminMux := http.NewServeMux()
+	if o.EnableProfiling {
+		adminMux.HandleFunc("/debug/pprof", pprof.Index)
+		adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		if o.EnableContentionProfiling {
+			runtime.SetBlockProfileRate(1)
+		}
+	}
+
+	metricsAddress, dedicated, enabled := o.MetricsListenAddress()
+	if enabled && !dedicated {
+		adminMux.Handle("/metrics", promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+	}
+
+	adminAddress := net.JoinHostPort(o.AdminBindAddress, fmt.Sprintf("%d", o.AdminServerPort))
+	if err := serveMux(adminAddress, adminMux); err != nil {
+		return fmt.Errorf("failed to start admin server on %q: %v", adminAddress, err)
+	}
+	klog.Infof("admin server serving on %q (pprof=%v, metrics=%v)", adminAddress, o.EnableProfiling, enabled && !dedicated)
+
+	if enabled && dedicated {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+		if err := serveMux(metricsAddress, metricsMux); err != nil {
+			return fmt.Errorf("failed to start metrics server on %q: %v", metricsAddress, err)
+		}
+		klog.Infof("metrics server serving on %q", metricsAddress)
+	}
+	return nil
+}
+
+// serveMux starts an HTTP server for mux on address and returns once the
+// listener is bound, serving in the background for the lifetime of the
+// process; a listener failing after startup is logged and the process keeps
+// running.
+func serveMux(address string, mux *http.ServeMux) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("server on %q exited: %v", address, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics defines the prometheus metrics served at /metrics on the
+// agent's admin (or dedicated metrics) server.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "konnectivity_agent"
+
+// Metrics holds the agent process's prometheus collectors, registered on a
+// dedicated Registry rather than the global DefaultRegisterer so the agent's
+// metrics are isolated from whatever else links into the binary.
+//
+// This only includes collectors the agent process itself can observe
+// accurately. Per-tunnel signals like active tunnel count, transfer-channel
+// depth, and gRPC keepalive failures live inside pkg/agent's ClientSet, which
+// this package has no visibility into; add collectors for those once
+// ClientSet exposes a way to observe them, rather than registering gauges
+// that would otherwise sit at a permanent, misleading zero.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	DialAttempts          *prometheus.CounterVec
+	LeaseDiscoveryLatency prometheus.Histogram
+}
+
+// NewMetrics creates and registers the agent's metrics on a fresh Registry.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		DialAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dial_attempts_total",
+			Help:      "Number of attempts the agent has made to build a ClientSet against its configured proxy-server endpoints, by outcome. Not broken down per-endpoint: NewAgentClientSet reports a single aggregate result for the whole configured set, so attributing it to one endpoint would misrepresent which endpoint(s) actually failed.",
+		}, []string{"status"}),
+		LeaseDiscoveryLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "lease_discovery_duration_seconds",
+			Help:      "Time taken to list and count server leases when --count-server-leases is set.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+	m.Registry.MustRegister(
+		m.DialAttempts,
+		m.LeaseDiscoveryLatency,
+	)
+	return m
+}
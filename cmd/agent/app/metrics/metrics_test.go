@@ -0,0 +1,45 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestNewMetricsRegistersCollectors(t *testing.T) {
+	m := NewMetrics()
+
+	m.DialAttempts.WithLabelValues("ok").Inc()
+	m.LeaseDiscoveryLatency.Observe(0.5)
+
+	families, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() returned error: %v", err)
+	}
+	byName := map[string]*dto.MetricFamily{}
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+	if _, ok := byName[namespace+"_dial_attempts_total"]; !ok {
+		t.Errorf("expected %s_dial_attempts_total to be registered", namespace)
+	}
+	if _, ok := byName[namespace+"_lease_discovery_duration_seconds"]; !ok {
+		t.Errorf("expected %s_lease_discovery_duration_seconds to be registered", namespace)
+	}
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	goflag "flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	configAPIVersion = "proxy.konnectivity.k8s.io/v1alpha1"
+	configKind       = "AgentConfiguration"
+)
+
+// AgentConfiguration is the versioned, on-disk representation of the agent's
+// configuration file. Its fields mirror the GrpcProxyAgentOptions flag
+// surface; every field is a pointer/slice so that "unset in the file" can be
+// told apart from an explicit zero value when merging with flags.
+//
+// Of these, only CountServerLeases, LeaseLabel, and LogVerbosity are actually
+// re-read by anything still running after startup (see
+// applyHotReloadableFields) and so take effect on a WatchConfigFile reload
+// without restarting the agent. Lease discovery is only started when
+// CountServerLeases is true at startup, so a reload can switch it off and on
+// again but cannot switch it on if it started off. The rest are baked once into the ClientSet
+// (SyncInterval, ProbeInterval, SyncIntervalCap, WarnOnChannelLimit,
+// ServerCountSource, via ClientSetConfig) or the kubernetes client
+// (KubeAPIQPS, KubeAPIBurst, via RestConfig) at process start; changing them
+// in the file after that only takes effect on restart, same as
+// ProxyServerHosts, and a reload logs a warning saying so instead of quietly
+// updating a struct field nothing reads.
+type AgentConfiguration struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	ProxyServerHosts []string `json:"proxyServerHosts,omitempty"`
+
+	SyncInterval       *time.Duration `json:"syncInterval,omitempty"`
+	ProbeInterval      *time.Duration `json:"probeInterval,omitempty"`
+	SyncIntervalCap    *time.Duration `json:"syncIntervalCap,omitempty"`
+	WarnOnChannelLimit *bool          `json:"warnOnChannelLimit,omitempty"`
+
+	CountServerLeases *bool   `json:"countServerLeases,omitempty"`
+	LeaseLabel        *string `json:"leaseLabel,omitempty"`
+	ServerCountSource *string `json:"serverCountSource,omitempty"`
+
+	KubeAPIQPS   *float32 `json:"kubeAPIQPS,omitempty"`
+	KubeAPIBurst *int     `json:"kubeAPIBurst,omitempty"`
+
+	LogVerbosity *int `json:"logVerbosity,omitempty"`
+}
+
+// LoadFromFile reads and validates an AgentConfiguration file. It accepts
+// both YAML and JSON, since sigs.k8s.io/yaml treats JSON as a subset of YAML.
+func LoadFromFile(path string) (*AgentConfiguration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %q: %v", path, err)
+	}
+	config := &AgentConfiguration{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %v", path, err)
+	}
+	if config.APIVersion != configAPIVersion || config.Kind != configKind {
+		return nil, fmt.Errorf("config file %q has apiVersion/kind %q/%q, expected %q/%q",
+			path, config.APIVersion, config.Kind, configAPIVersion, configKind)
+	}
+	return config, nil
+}
+
+// Merge applies config on top of o, skipping any field that was explicitly
+// set via flags. Flags always win over the config file; the config file
+// always wins over the built-in default. It must be called after flags.Parse
+// and before any goroutine that reads o's hot-reloadable fields has started,
+// so unlike applyHotReloadableFields it doesn't need o's mutex.
+func (o *GrpcProxyAgentOptions) Merge(flags *pflag.FlagSet, config *AgentConfiguration) {
+	if config == nil {
+		return
+	}
+	if len(config.ProxyServerHosts) > 0 && !flags.Changed("proxy-server-hosts") &&
+		!flags.Changed("proxy-server-host") && !flags.Changed("proxy-server-port") {
+		o.ProxyServerHosts = config.ProxyServerHosts
+	}
+	if config.SyncInterval != nil && !flags.Changed("sync-interval") {
+		o.SyncInterval = *config.SyncInterval
+	}
+	if config.ProbeInterval != nil && !flags.Changed("probe-interval") {
+		o.ProbeInterval = *config.ProbeInterval
+	}
+	if config.SyncIntervalCap != nil && !flags.Changed("sync-interval-cap") {
+		o.SyncIntervalCap = *config.SyncIntervalCap
+	}
+	if config.WarnOnChannelLimit != nil && !flags.Changed("warn-on-channel-limit") {
+		o.WarnOnChannelLimit = *config.WarnOnChannelLimit
+	}
+	if config.CountServerLeases != nil && !flags.Changed("count-server-leases") {
+		o.CountServerLeases = *config.CountServerLeases
+	}
+	if config.LeaseLabel != nil && !flags.Changed("lease-label") {
+		o.LeaseLabel = *config.LeaseLabel
+	}
+	if config.ServerCountSource != nil && !flags.Changed("server-count-source") {
+		o.ServerCountSource = *config.ServerCountSource
+	}
+	if config.KubeAPIQPS != nil && !flags.Changed("kube-api-qps") {
+		o.KubeAPIQPS = *config.KubeAPIQPS
+	}
+	if config.KubeAPIBurst != nil && !flags.Changed("kube-api-burst") {
+		o.KubeAPIBurst = *config.KubeAPIBurst
+	}
+	if config.LogVerbosity != nil && !isGoFlagSet("v") {
+		setLogVerbosity(*config.LogVerbosity)
+	}
+}
+
+// isGoFlagSet reports whether name was explicitly set on the command line on
+// goflag.CommandLine, the standard library FlagSet klog.InitFlags registers
+// "-v" on. klog's verbosity flag lives there rather than on the pflag.FlagSet
+// GrpcProxyAgentOptions otherwise uses, so it needs its own "was this set on
+// the command line" check instead of pflag's FlagSet.Changed.
+func isGoFlagSet(name string) bool {
+	set := false
+	goflag.CommandLine.Visit(func(f *goflag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// WatchConfigFile watches o.ConfigPath for changes. On each write it
+// re-reads and re-validates the file and applies the subset of fields that
+// are safe to change at runtime (see applyHotReloadableFields), calling
+// onChange with the updated options. Any other field changing in the file is
+// logged and ignored; picking it up requires restarting the agent.
+// WatchConfigFile is a no-op if o.ConfigPath is empty.
+func (o *GrpcProxyAgentOptions) WatchConfigFile(onChange func(*GrpcProxyAgentOptions) error) (*fsnotify.Watcher, error) {
+	if o.ConfigPath == "" {
+		return nil, nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher for config file %q: %v", o.ConfigPath, err)
+	}
+	// Watch the parent directory rather than the file itself: ConfigMap
+	// volume mounts (the common way this file reaches the agent) are updated
+	// by atomically swapping a "..data" symlink, which replaces the watched
+	// file's directory entry and silently tears down a watch placed directly
+	// on it.
+	dir := filepath.Dir(o.ConfigPath)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch directory %q of config file %q: %v", dir, o.ConfigPath, err)
+	}
+	configFile := filepath.Clean(o.ConfigPath)
+	// realConfigFile tracks what o.ConfigPath currently resolves to, so a
+	// ConfigMap's "..data" symlink swap can be detected even though the
+	// event fsnotify delivers names the symlink, not configFile itself: the
+	// literal file at configFile never has its own Create/Write/Rename
+	// event, only the directory entry it points through does. This mirrors
+	// how viper's WatchConfig handles the same ConfigMap update pattern.
+	realConfigFile, _ := filepath.EvalSymlinks(o.ConfigPath)
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				currentConfigFile, _ := filepath.EvalSymlinks(o.ConfigPath)
+				changedDirectly := filepath.Clean(event.Name) == configFile &&
+					event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0
+				changedViaSymlinkSwap := currentConfigFile != "" && currentConfigFile != realConfigFile
+				if !changedDirectly && !changedViaSymlinkSwap {
+					continue
+				}
+				realConfigFile = currentConfigFile
+				o.reloadConfigFile(onChange)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				klog.Errorf("config file %q watcher error: %v", o.ConfigPath, err)
+			}
+		}
+	}()
+	return watcher, nil
+}
+
+func (o *GrpcProxyAgentOptions) reloadConfigFile(onChange func(*GrpcProxyAgentOptions) error) {
+	config, err := LoadFromFile(o.ConfigPath)
+	if err != nil {
+		klog.Errorf("failed to reload config file %q, keeping previous configuration: %v", o.ConfigPath, err)
+		return
+	}
+
+	// Validate against a scratch copy first so a bad file never partially
+	// applies to the live options before Validate rejects it.
+	// Log verbosity is process-global rather than a field of o, so it is left
+	// out of the scratch copy and only set once the file has validated.
+	candidate := *o
+	scratchConfig := *config
+	scratchConfig.LogVerbosity = nil
+	applyHotReloadableFields(&candidate, &scratchConfig)
+	if err := candidate.Validate(); err != nil {
+		klog.Errorf("reloaded config file %q is invalid, keeping previous configuration: %v", o.ConfigPath, err)
+		return
+	}
+	warnOnUnsupportedChanges(o, config)
+
+	// Apply only the hot-reloadable fields to the live options, rather than
+	// overwriting the whole struct, so a reload can't clobber fields (like
+	// ProxyServerHosts) that are documented as requiring a restart. This runs
+	// concurrently with the agent's sync/probe loops, so it takes the same
+	// lock those loops must take to read these fields (see GrpcProxyAgentOptions.mu).
+	o.Lock()
+	applyHotReloadableFields(o, config)
+	o.Unlock()
+	if onChange != nil {
+		if err := onChange(o); err != nil {
+			klog.Errorf("failed to apply reloaded config file %q: %v", o.ConfigPath, err)
+		}
+	}
+}
+
+// applyHotReloadableFields applies the subset of config that something
+// running past startup actually re-reads: CountServerLeases and LeaseLabel
+// are read fresh on every lease-discovery tick (see AgentServer.runLeaseDiscovery;
+// those ticks only run if CountServerLeases was true at startup),
+// and LogVerbosity takes effect immediately via klog. Every other field on
+// AgentConfiguration is baked into a ClientSet or kubernetes client at
+// startup and can't be swapped out from under those without rebuilding them,
+// so it's handled by warnOnUnsupportedChanges instead.
+func applyHotReloadableFields(o *GrpcProxyAgentOptions, config *AgentConfiguration) {
+	if config.CountServerLeases != nil {
+		o.CountServerLeases = *config.CountServerLeases
+	}
+	if config.LeaseLabel != nil {
+		o.LeaseLabel = *config.LeaseLabel
+	}
+	if config.LogVerbosity != nil {
+		setLogVerbosity(*config.LogVerbosity)
+	}
+}
+
+// warnOnUnsupportedChanges logs a warning for any field in the reloaded
+// config that applyHotReloadableFields doesn't apply but differs from the
+// currently running options, so operators know a restart is needed to pick
+// it up instead of assuming the reload already did.
+func warnOnUnsupportedChanges(current *GrpcProxyAgentOptions, config *AgentConfiguration) {
+	warn := func(field string, changed bool) {
+		if changed {
+			klog.Warningf("config file %q changed %s; this field is not hot-reloadable, restart the agent to apply it", current.ConfigPath, field)
+		}
+	}
+	warn("proxyServerHosts", len(config.ProxyServerHosts) > 0 && !reflect.DeepEqual(config.ProxyServerHosts, current.ProxyServerHosts))
+	warn("syncInterval", config.SyncInterval != nil && *config.SyncInterval != current.SyncInterval)
+	warn("probeInterval", config.ProbeInterval != nil && *config.ProbeInterval != current.ProbeInterval)
+	warn("syncIntervalCap", config.SyncIntervalCap != nil && *config.SyncIntervalCap != current.SyncIntervalCap)
+	warn("warnOnChannelLimit", config.WarnOnChannelLimit != nil && *config.WarnOnChannelLimit != current.WarnOnChannelLimit)
+	warn("serverCountSource", config.ServerCountSource != nil && *config.ServerCountSource != current.ServerCountSource)
+	warn("kubeAPIQPS", config.KubeAPIQPS != nil && *config.KubeAPIQPS != current.KubeAPIQPS)
+	warn("kubeAPIBurst", config.KubeAPIBurst != nil && *config.KubeAPIBurst != current.KubeAPIBurst)
+}
+
+// setLogVerbosity sets klog's "-v" verbosity level, which is registered on
+// the standard library flag.CommandLine by klog.InitFlags.
+func setLogVerbosity(level int) {
+	if f := goflag.CommandLine.Lookup("v"); f != nil {
+		if err := f.Value.Set(fmt.Sprintf("%d", level)); err != nil {
+			klog.Errorf("failed to set log verbosity to %d: %v", level, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"testing"
+	"time"
+)
+
+func boolPtr(b bool) *bool                       { return &b }
+func stringPtr(s string) *string                 { return &s }
+func durationPtr(d time.Duration) *time.Duration { return &d }
+
+func TestMergeFlagsWinOverConfig(t *testing.T) {
+	o := NewGrpcProxyAgentOptions()
+	flags := o.Flags()
+	if err := flags.Parse([]string{"--lease-label=k8s-app=from-flag"}); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+
+	config := &AgentConfiguration{
+		APIVersion:        configAPIVersion,
+		Kind:              configKind,
+		LeaseLabel:        stringPtr("k8s-app=from-file"),
+		CountServerLeases: boolPtr(true),
+	}
+	o.Merge(flags, config)
+
+	if o.LeaseLabel != "k8s-app=from-flag" {
+		t.Errorf("LeaseLabel = %q, want the flag value to win", o.LeaseLabel)
+	}
+	if !o.CountServerLeases {
+		t.Errorf("CountServerLeases = false, want the config file value applied since no flag set it")
+	}
+}
+
+func TestMergeDeprecatedFlagsBlockProxyServerHostsFromFile(t *testing.T) {
+	o := NewGrpcProxyAgentOptions()
+	flags := o.Flags()
+	if err := flags.Parse([]string{"--proxy-server-host=cli.example.com", "--proxy-server-port=9090"}); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+	if err := o.Complete(flags); err != nil {
+		t.Fatalf("Complete() returned error: %v", err)
+	}
+
+	config := &AgentConfiguration{
+		APIVersion:       configAPIVersion,
+		Kind:             configKind,
+		ProxyServerHosts: []string{"file.example.com:1234"},
+	}
+	o.Merge(flags, config)
+
+	if len(o.ProxyServerHosts) != 1 || o.ProxyServerHosts[0] != "cli.example.com:9090" {
+		t.Errorf("ProxyServerHosts = %v, want the deprecated CLI flags to win over the config file", o.ProxyServerHosts)
+	}
+}
+
+func TestApplyHotReloadableFieldsOnlyTouchesLiveFields(t *testing.T) {
+	o := NewGrpcProxyAgentOptions()
+	originalSyncInterval := o.SyncInterval
+	originalKubeAPIQPS := o.KubeAPIQPS
+
+	config := &AgentConfiguration{
+		APIVersion:        configAPIVersion,
+		Kind:              configKind,
+		SyncInterval:      durationPtr(originalSyncInterval + time.Minute),
+		KubeAPIQPS:        func() *float32 { v := originalKubeAPIQPS + 10; return &v }(),
+		CountServerLeases: boolPtr(true),
+		LeaseLabel:        stringPtr("k8s-app=reloaded"),
+	}
+	applyHotReloadableFields(o, config)
+
+	if o.SyncInterval != originalSyncInterval {
+		t.Errorf("SyncInterval = %v, want it left untouched: it's baked into the ClientSet at startup, not hot-reloadable", o.SyncInterval)
+	}
+	if o.KubeAPIQPS != originalKubeAPIQPS {
+		t.Errorf("KubeAPIQPS = %v, want it left untouched: it's baked into the kubernetes client at startup, not hot-reloadable", o.KubeAPIQPS)
+	}
+	if !o.CountServerLeases {
+		t.Error("CountServerLeases was not applied, want it hot-reloaded")
+	}
+	if o.LeaseLabel != "k8s-app=reloaded" {
+		t.Errorf("LeaseLabel = %q, want it hot-reloaded", o.LeaseLabel)
+	}
+}
@@ -22,12 +22,15 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/spf13/pflag"
 	"google.golang.org/grpc"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 
 	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
@@ -35,6 +38,11 @@ import (
 	"sigs.k8s.io/apiserver-network-proxy/proto/header"
 )
 
+const (
+	defaultProxyServerHost = "127.0.0.1"
+	defaultProxyServerPort = 8091
+)
+
 type GrpcProxyAgentOptions struct {
 	// Configuration for authenticating with the proxy-server
 	AgentCert string
@@ -42,9 +50,17 @@ type GrpcProxyAgentOptions struct {
 	CaCert    string
 
 	// Configuration for connecting to the proxy-server
+	// Deprecated: use ProxyServerHosts instead. If set, it is appended to
+	// ProxyServerHosts as "host:ProxyServerPort".
 	ProxyServerHost string
+	// Deprecated: use ProxyServerHosts instead.
 	ProxyServerPort int
-	AlpnProtos      []string
+	// ProxyServerHosts is the list of "host:port" endpoints of the proxy-server(s)
+	// this agent should maintain connections to. The agent dials these round-robin
+	// in addition to whatever servers it discovers via the lease/server-count
+	// mechanisms, opening one connection per unique server ID.
+	ProxyServerHosts []string
+	AlpnProtos       []string
 
 	// Bind address for the health connections.
 	HealthServerHost string
@@ -59,6 +75,13 @@ type GrpcProxyAgentOptions struct {
 	// If EnableProfiling is true, this enables the lock contention
 	// profiling at host:adminPort/debug/pprof/block.
 	EnableContentionProfiling bool
+	// Enables serving prometheus metrics at /metrics.
+	EnableMetrics bool
+	// Bind address for the metrics connections, if served on a dedicated listener.
+	MetricsBindAddress string
+	// Port we listen for metrics connections on, if served on a dedicated listener.
+	// If zero, metrics are served on the admin server alongside pprof.
+	MetricsBindPort int
 
 	AgentID          string
 	AgentIdentifiers string
@@ -95,11 +118,39 @@ type GrpcProxyAgentOptions struct {
 	KubeconfigPath string
 	// Content type of requests sent to apiserver.
 	APIContentType string
+	// Path to a versioned AgentConfiguration file. Values in this file are
+	// overridden by any flag that is explicitly set on the command line.
+	ConfigPath string
+	// QPS to use for interactions with the kubernetes apiserver client used for lease listing.
+	KubeAPIQPS float32
+	// Burst to use for interactions with the kubernetes apiserver client used for lease listing.
+	KubeAPIBurst int
+
+	// mu guards the fields WatchConfigFile is allowed to hot-swap at runtime
+	// (see applyHotReloadableFields in config.go) against concurrent reads
+	// from the agent's sync/probe loops. Callers reading any of those fields
+	// after startup must take RLock/RUnlock; WatchConfigFile takes Lock/Unlock
+	// when applying a reload. It's a pointer so copying a GrpcProxyAgentOptions
+	// by value (as reloadConfigFile does to validate a candidate) shares the
+	// same mutex rather than tripping go vet's copylocks check.
+	mu *sync.RWMutex
 }
 
+// Lock acquires the mutex guarding the hot-reloadable fields for writing.
+func (o *GrpcProxyAgentOptions) Lock() { o.mu.Lock() }
+
+// Unlock releases the mutex acquired by Lock.
+func (o *GrpcProxyAgentOptions) Unlock() { o.mu.Unlock() }
+
+// RLock acquires the mutex guarding the hot-reloadable fields for reading.
+func (o *GrpcProxyAgentOptions) RLock() { o.mu.RLock() }
+
+// RUnlock releases the mutex acquired by RLock.
+func (o *GrpcProxyAgentOptions) RUnlock() { o.mu.RUnlock() }
+
 func (o *GrpcProxyAgentOptions) ClientSetConfig(dialOptions ...grpc.DialOption) *agent.ClientSetConfig {
 	return &agent.ClientSetConfig{
-		Address:                 net.JoinHostPort(o.ProxyServerHost, strconv.Itoa(o.ProxyServerPort)),
+		Addresses:               o.ProxyServerHosts,
 		AgentID:                 o.AgentID,
 		AgentIdentifiers:        o.AgentIdentifiers,
 		SyncInterval:            o.SyncInterval,
@@ -121,6 +172,9 @@ func (o *GrpcProxyAgentOptions) Flags() *pflag.FlagSet {
 	flags.StringVar(&o.CaCert, "ca-cert", o.CaCert, "If non-empty the CAs we use to validate clients.")
 	flags.StringVar(&o.ProxyServerHost, "proxy-server-host", o.ProxyServerHost, "The hostname to use to connect to the proxy-server.")
 	flags.IntVar(&o.ProxyServerPort, "proxy-server-port", o.ProxyServerPort, "The port the proxy server is listening on.")
+	flags.MarkDeprecated("proxy-server-host", "use --proxy-server-hosts instead")
+	flags.MarkDeprecated("proxy-server-port", "use --proxy-server-hosts instead")
+	flags.StringSliceVar(&o.ProxyServerHosts, "proxy-server-hosts", o.ProxyServerHosts, "The list of \"host:port\" endpoints of the proxy-server(s) to connect to. May be specified multiple times or as a comma-separated list. The agent round-robins initial dials across this list and opens one connection per unique server ID it discovers.")
 	flags.StringSliceVar(&o.AlpnProtos, "alpn-proto", o.AlpnProtos, "Additional ALPN protocols to be presented when connecting to the server. Useful to distinguish between network proxy and apiserver connections that share the same destination address.")
 	flags.StringVar(&o.HealthServerHost, "health-server-host", o.HealthServerHost, "The host address to listen on, without port.")
 	flags.IntVar(&o.HealthServerPort, "health-server-port", o.HealthServerPort, "The port the health server is listening on.")
@@ -128,6 +182,9 @@ func (o *GrpcProxyAgentOptions) Flags() *pflag.FlagSet {
 	flags.StringVar(&o.AdminBindAddress, "admin-bind-address", o.AdminBindAddress, "Bind address for admin connections. If empty, we will bind to all interfaces.")
 	flags.BoolVar(&o.EnableProfiling, "enable-profiling", o.EnableProfiling, "enable pprof at host:admin-port/debug/pprof")
 	flags.BoolVar(&o.EnableContentionProfiling, "enable-contention-profiling", o.EnableContentionProfiling, "enable contention profiling at host:admin-port/debug/pprof/block. \"--enable-profiling\" must also be set.")
+	flags.BoolVar(&o.EnableMetrics, "enable-metrics", o.EnableMetrics, "enable prometheus metrics at /metrics")
+	flags.StringVar(&o.MetricsBindAddress, "metrics-bind-address", o.MetricsBindAddress, "Bind address for metrics connections. Only used if --metrics-bind-port is set to serve metrics on a dedicated listener instead of the admin server.")
+	flags.IntVar(&o.MetricsBindPort, "metrics-bind-port", o.MetricsBindPort, "If non-zero, serve metrics on a dedicated listener at this port instead of on the admin server.")
 	flags.StringVar(&o.AgentID, "agent-id", o.AgentID, "The unique ID of this agent. Can also be set by the 'PROXY_AGENT_ID' environment variable. Default to a generated uuid if not set.")
 	flags.DurationVar(&o.SyncInterval, "sync-interval", o.SyncInterval, "The initial interval by which the agent periodically checks if it has connections to all instances of the proxy server.")
 	flags.DurationVar(&o.ProbeInterval, "probe-interval", o.ProbeInterval, "The interval by which the agent periodically checks if its connections to the proxy server are ready.")
@@ -144,6 +201,9 @@ func (o *GrpcProxyAgentOptions) Flags() *pflag.FlagSet {
 	flags.StringVar(&o.ServerCountSource, "server-count-source", o.ServerCountSource, "Defines how the server counts from lease and from server responses are combined. Possible values: 'default' to use only one source (server or leases depending on other flags), 'max' to take the larger value.")
 	flags.StringVar(&o.KubeconfigPath, "kubeconfig", o.KubeconfigPath, "Path to the kubeconfig file")
 	flags.StringVar(&o.APIContentType, "kube-api-content-type", o.APIContentType, "Content type of requests sent to apiserver.")
+	flags.Float32Var(&o.KubeAPIQPS, "kube-api-qps", o.KubeAPIQPS, "QPS to use while communicating with the kubernetes apiserver for lease listing.")
+	flags.IntVar(&o.KubeAPIBurst, "kube-api-burst", o.KubeAPIBurst, "Burst to use while communicating with the kubernetes apiserver for lease listing.")
+	flags.StringVar(&o.ConfigPath, "config", o.ConfigPath, "Path to an AgentConfiguration file. Values in the file are overridden by any flag explicitly set on the command line. The file is watched and a safe subset of fields is hot-reloaded on change.")
 	return flags
 }
 
@@ -153,6 +213,7 @@ func (o *GrpcProxyAgentOptions) Print() {
 	klog.V(1).Infof("CACert set to %q.\n", o.CaCert)
 	klog.V(1).Infof("ProxyServerHost set to %q.\n", o.ProxyServerHost)
 	klog.V(1).Infof("ProxyServerPort set to %d.\n", o.ProxyServerPort)
+	klog.V(1).Infof("ProxyServerHosts set to %v.\n", o.ProxyServerHosts)
 	klog.V(1).Infof("ALPNProtos set to %+s.\n", o.AlpnProtos)
 	klog.V(1).Infof("HealthServerHost set to %s\n", o.HealthServerHost)
 	klog.V(1).Infof("HealthServerPort set to %d.\n", o.HealthServerPort)
@@ -160,6 +221,9 @@ func (o *GrpcProxyAgentOptions) Print() {
 	klog.V(1).Infof("AdminServerPort set to %d.\n", o.AdminServerPort)
 	klog.V(1).Infof("EnableProfiling set to %v.\n", o.EnableProfiling)
 	klog.V(1).Infof("EnableContentionProfiling set to %v.\n", o.EnableContentionProfiling)
+	klog.V(1).Infof("EnableMetrics set to %v.\n", o.EnableMetrics)
+	klog.V(1).Infof("MetricsBindAddress set to %q.\n", o.MetricsBindAddress)
+	klog.V(1).Infof("MetricsBindPort set to %d.\n", o.MetricsBindPort)
 	klog.V(1).Infof("AgentID set to %s.\n", o.AgentID)
 	klog.V(1).Infof("SyncInterval set to %v.\n", o.SyncInterval)
 	klog.V(1).Infof("ProbeInterval set to %v.\n", o.ProbeInterval)
@@ -175,6 +239,26 @@ func (o *GrpcProxyAgentOptions) Print() {
 	klog.V(1).Infof("ServerCountSource set to %s.\n", o.ServerCountSource)
 	klog.V(1).Infof("ChannelSize set to %d.\n", o.XfrChannelSize)
 	klog.V(1).Infof("APIContentType set to %v.\n", o.APIContentType)
+	klog.V(1).Infof("KubeAPIQPS set to %v.\n", o.KubeAPIQPS)
+	klog.V(1).Infof("KubeAPIBurst set to %d.\n", o.KubeAPIBurst)
+	klog.V(1).Infof("ConfigPath set to %q.\n", o.ConfigPath)
+}
+
+// Complete fills in fields that depend on the values of other fields, such as
+// folding the deprecated single-host/single-port flags into ProxyServerHosts.
+// It must be called after flags.Parse and before Validate.
+func (o *GrpcProxyAgentOptions) Complete(flags *pflag.FlagSet) error {
+	if flags.Changed("proxy-server-host") || flags.Changed("proxy-server-port") {
+		o.ProxyServerHosts = append(o.ProxyServerHosts, net.JoinHostPort(o.ProxyServerHost, strconv.Itoa(o.ProxyServerPort)))
+	}
+	// Only fall back to the default endpoint if neither --proxy-server-hosts
+	// nor the deprecated --proxy-server-host/--proxy-server-port were used.
+	// ProxyServerHosts itself defaults to empty so this can't double up with
+	// a value the operator actually asked for.
+	if len(o.ProxyServerHosts) == 0 {
+		o.ProxyServerHosts = []string{net.JoinHostPort(defaultProxyServerHost, strconv.Itoa(defaultProxyServerPort))}
+	}
+	return nil
 }
 
 func (o *GrpcProxyAgentOptions) Validate() error {
@@ -199,8 +283,13 @@ func (o *GrpcProxyAgentOptions) Validate() error {
 			return fmt.Errorf("error checking agent CA cert %s, got %v", o.CaCert, err)
 		}
 	}
-	if o.ProxyServerPort <= 0 {
-		return fmt.Errorf("proxy server port %d must be greater than 0", o.ProxyServerPort)
+	if len(o.ProxyServerHosts) == 0 {
+		return fmt.Errorf("at least one proxy-server endpoint must be set via --proxy-server-hosts (or the deprecated --proxy-server-host/--proxy-server-port)")
+	}
+	for _, hostport := range o.ProxyServerHosts {
+		if _, _, err := net.SplitHostPort(hostport); err != nil {
+			return fmt.Errorf("invalid proxy-server endpoint %q, expected \"host:port\": %v", hostport, err)
+		}
 	}
 	if o.HealthServerPort <= 0 {
 		return fmt.Errorf("health server port %d must be greater than 0", o.HealthServerPort)
@@ -214,6 +303,17 @@ func (o *GrpcProxyAgentOptions) Validate() error {
 	if o.EnableContentionProfiling && !o.EnableProfiling {
 		return fmt.Errorf("if --enable-contention-profiling is set, --enable-profiling must also be set")
 	}
+	if o.EnableMetrics && o.MetricsBindPort != 0 {
+		if o.MetricsBindPort == o.AdminServerPort {
+			return fmt.Errorf("--metrics-bind-port %d must differ from --admin-server-port when serving metrics on a dedicated listener", o.MetricsBindPort)
+		}
+		if o.MetricsBindPort < 0 {
+			return fmt.Errorf("--metrics-bind-port %d must not be negative", o.MetricsBindPort)
+		}
+	}
+	if !o.EnableMetrics && o.MetricsBindPort != 0 {
+		return fmt.Errorf("--metrics-bind-port is set but --enable-metrics is false")
+	}
 	if o.SyncInterval > o.SyncIntervalCap {
 		return fmt.Errorf("sync interval %v must be less than sync interval cap %v", o.SyncInterval, o.SyncIntervalCap)
 	}
@@ -230,6 +330,11 @@ func (o *GrpcProxyAgentOptions) Validate() error {
 			return fmt.Errorf("error checking KubeconfigPath %q, got %v", o.KubeconfigPath, err)
 		}
 	}
+	if o.ConfigPath != "" {
+		if _, err := os.Stat(o.ConfigPath); os.IsNotExist(err) {
+			return fmt.Errorf("error checking ConfigPath %q, got %v", o.ConfigPath, err)
+		}
+	}
 	// Validate labels provided.
 	if o.CountServerLeases {
 		_, err := util.ParseLabels(o.LeaseLabel)
@@ -242,10 +347,56 @@ func (o *GrpcProxyAgentOptions) Validate() error {
 			return fmt.Errorf("--server-count-source must be one of '', 'default', 'max', got %v", o.ServerCountSource)
 		}
 	}
+	if o.KubeAPIQPS <= 0 {
+		return fmt.Errorf("--kube-api-qps %v must be greater than 0", o.KubeAPIQPS)
+	}
+	if o.KubeAPIBurst <= 0 {
+		return fmt.Errorf("--kube-api-burst %v must be greater than 0", o.KubeAPIBurst)
+	}
+	if float32(o.KubeAPIBurst) < o.KubeAPIQPS {
+		return fmt.Errorf("--kube-api-burst %v must be greater than or equal to --kube-api-qps %v", o.KubeAPIBurst, o.KubeAPIQPS)
+	}
 
 	return nil
 }
 
+// MetricsListenAddress returns the "host:port" the agent should serve
+// prometheus metrics on, and whether that is a dedicated listener separate
+// from the admin server. If EnableMetrics is false, ok is false and metrics
+// should not be served at all.
+func (o *GrpcProxyAgentOptions) MetricsListenAddress() (address string, dedicated bool, ok bool) {
+	if !o.EnableMetrics {
+		return "", false, false
+	}
+	if o.MetricsBindPort == 0 {
+		return "", false, true
+	}
+	return net.JoinHostPort(o.MetricsBindAddress, strconv.Itoa(o.MetricsBindPort)), true, true
+}
+
+// RestConfig builds the rest.Config used by the kubernetes client that lists
+// server leases when --count-server-leases is set. An empty KubeconfigPath
+// falls back to in-cluster configuration; if neither is available, an error
+// is returned with a clear message rather than silently using defaults.
+func (o *GrpcProxyAgentOptions) RestConfig() (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = o.KubeconfigPath
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{})
+	if o.KubeconfigPath == "" && os.Getenv("KUBECONFIG") == "" {
+		if _, err := os.Stat(loadingRules.GetDefaultFilename()); os.IsNotExist(err) {
+			klog.Warning("no --kubeconfig, $KUBECONFIG, or default kubeconfig file found, falling back to in-cluster configuration")
+		}
+	}
+	config, err := loader.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build kubernetes client config (kubeconfig=%q): %v", o.KubeconfigPath, err)
+	}
+	config.QPS = o.KubeAPIQPS
+	config.Burst = o.KubeAPIBurst
+	config.ContentType = o.APIContentType
+	return config, nil
+}
+
 func validateAgentIdentifiers(agentIdentifiers string) error {
 	decoded, err := url.ParseQuery(agentIdentifiers)
 	if err != nil {
@@ -270,14 +421,18 @@ func NewGrpcProxyAgentOptions() *GrpcProxyAgentOptions {
 		AgentCert:                 "",
 		AgentKey:                  "",
 		CaCert:                    "",
-		ProxyServerHost:           "127.0.0.1",
-		ProxyServerPort:           8091,
+		ProxyServerHost:           defaultProxyServerHost,
+		ProxyServerPort:           defaultProxyServerPort,
+		ProxyServerHosts:          nil,
 		HealthServerHost:          "",
 		HealthServerPort:          8093,
 		AdminBindAddress:          "127.0.0.1",
 		AdminServerPort:           8094,
 		EnableProfiling:           false,
 		EnableContentionProfiling: false,
+		EnableMetrics:             true,
+		MetricsBindAddress:        "127.0.0.1",
+		MetricsBindPort:           0,
 		AgentID:                   defaultAgentID(),
 		AgentIdentifiers:          "",
 		SyncInterval:              1 * time.Second,
@@ -294,6 +449,10 @@ func NewGrpcProxyAgentOptions() *GrpcProxyAgentOptions {
 		ServerCountSource:         "default",
 		KubeconfigPath:            "",
 		APIContentType:            runtime.ContentTypeProtobuf,
+		KubeAPIQPS:                50,
+		KubeAPIBurst:              100,
+		ConfigPath:                "",
+		mu:                        &sync.RWMutex{},
 	}
 	return &o
 }
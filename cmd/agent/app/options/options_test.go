@@ -0,0 +1,183 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package options
+
+import (
+	"testing"
+)
+
+func TestCompleteProxyServerHosts(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "nothing set falls back to the default endpoint",
+			args: nil,
+			want: []string{"127.0.0.1:8091"},
+		},
+		{
+			name: "deprecated port only still uses the default host",
+			args: []string{"--proxy-server-port=9090"},
+			want: []string{"127.0.0.1:9090"},
+		},
+		{
+			name: "deprecated host and port",
+			args: []string{"--proxy-server-host=proxy.example.com", "--proxy-server-port=9090"},
+			want: []string{"proxy.example.com:9090"},
+		},
+		{
+			name: "new flag wins and deprecated default is not appended",
+			args: []string{"--proxy-server-hosts=a:1,b:2"},
+			want: []string{"a:1", "b:2"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o := NewGrpcProxyAgentOptions()
+			flags := o.Flags()
+			if err := flags.Parse(c.args); err != nil {
+				t.Fatalf("failed to parse flags: %v", err)
+			}
+			if err := o.Complete(flags); err != nil {
+				t.Fatalf("Complete() returned error: %v", err)
+			}
+			if len(o.ProxyServerHosts) != len(c.want) {
+				t.Fatalf("ProxyServerHosts = %v, want %v", o.ProxyServerHosts, c.want)
+			}
+			for i, host := range c.want {
+				if o.ProxyServerHosts[i] != host {
+					t.Errorf("ProxyServerHosts[%d] = %q, want %q", i, o.ProxyServerHosts[i], host)
+				}
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *GrpcProxyAgentOptions {
+		o := NewGrpcProxyAgentOptions()
+		o.ProxyServerHosts = []string{"127.0.0.1:8091"}
+		return o
+	}
+
+	cases := []struct {
+		name    string
+		mutate  func(o *GrpcProxyAgentOptions)
+		wantErr bool
+	}{
+		{
+			name:    "defaults are valid",
+			mutate:  func(o *GrpcProxyAgentOptions) {},
+			wantErr: false,
+		},
+		{
+			name:    "no proxy-server endpoints",
+			mutate:  func(o *GrpcProxyAgentOptions) { o.ProxyServerHosts = nil },
+			wantErr: true,
+		},
+		{
+			name:    "malformed proxy-server endpoint",
+			mutate:  func(o *GrpcProxyAgentOptions) { o.ProxyServerHosts = []string{"not-a-host-port"} },
+			wantErr: true,
+		},
+		{
+			name:    "kube-api-qps must be positive",
+			mutate:  func(o *GrpcProxyAgentOptions) { o.KubeAPIQPS = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "kube-api-burst must be positive",
+			mutate:  func(o *GrpcProxyAgentOptions) { o.KubeAPIBurst = 0 },
+			wantErr: true,
+		},
+		{
+			name: "kube-api-burst must be at least kube-api-qps",
+			mutate: func(o *GrpcProxyAgentOptions) {
+				o.KubeAPIQPS = 100
+				o.KubeAPIBurst = 10
+			},
+			wantErr: true,
+		},
+		{
+			name: "metrics port collides with admin port",
+			mutate: func(o *GrpcProxyAgentOptions) {
+				o.EnableMetrics = true
+				o.MetricsBindPort = o.AdminServerPort
+			},
+			wantErr: true,
+		},
+		{
+			name: "metrics port set without enabling metrics",
+			mutate: func(o *GrpcProxyAgentOptions) {
+				o.EnableMetrics = false
+				o.MetricsBindPort = 9095
+			},
+			wantErr: true,
+		},
+		{
+			name: "dedicated metrics port is valid",
+			mutate: func(o *GrpcProxyAgentOptions) {
+				o.EnableMetrics = true
+				o.MetricsBindPort = o.AdminServerPort + 1
+			},
+			wantErr: false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o := valid()
+			c.mutate(o)
+			err := o.Validate()
+			if c.wantErr && err == nil {
+				t.Fatal("Validate() = nil, want error")
+			}
+			if !c.wantErr && err != nil {
+				t.Fatalf("Validate() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestMetricsListenAddress(t *testing.T) {
+	cases := []struct {
+		name          string
+		enableMetrics bool
+		bindPort      int
+		wantOK        bool
+		wantDedicated bool
+	}{
+		{name: "metrics disabled", enableMetrics: false, bindPort: 0, wantOK: false},
+		{name: "colocated with admin server", enableMetrics: true, bindPort: 0, wantOK: true, wantDedicated: false},
+		{name: "dedicated listener", enableMetrics: true, bindPort: 9095, wantOK: true, wantDedicated: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o := NewGrpcProxyAgentOptions()
+			o.EnableMetrics = c.enableMetrics
+			o.MetricsBindPort = c.bindPort
+			_, dedicated, ok := o.MetricsListenAddress()
+			if ok != c.wantOK {
+				t.Errorf("ok = %v, want %v", ok, c.wantOK)
+			}
+			if ok && dedicated != c.wantDedicated {
+				t.Errorf("dedicated = %v, want %v", dedicated, c.wantDedicated)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/apiserver-network-proxy/cmd/agent/app/metrics"
+	"sigs.k8s.io/apiserver-network-proxy/cmd/agent/app/options"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/agent"
+	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
+)
+
+// AgentServer wires a GrpcProxyAgentOptions into a running agent process: it
+// completes and validates the options, builds the agent's ClientSet against
+// every configured proxy-server endpoint, and serves the admin/metrics
+// surfaces until stopCh is closed.
+type AgentServer struct {
+	o       *options.GrpcProxyAgentOptions
+	metrics *metrics.Metrics
+
+	clientSet *agent.ClientSet
+}
+
+func NewAgentServer(o *options.GrpcProxyAgentOptions) *AgentServer {
+	return &AgentServer{o: o, metrics: metrics.NewMetrics()}
+}
+
+// Run completes and validates o against flags, dials every configured
+// proxy-server endpoint, and blocks serving the agent until stopCh is closed.
+func (s *AgentServer) Run(flags *pflag.FlagSet, stopCh <-chan struct{}) error {
+	o := s.o
+	if err := o.Complete(flags); err != nil {
+		return fmt.Errorf("failed to complete agent options: %v", err)
+	}
+	if o.ConfigPath != "" {
+		config, err := options.LoadFromFile(o.ConfigPath)
+		if err != nil {
+			return fmt.Errorf("failed to load --config %q: %v", o.ConfigPath, err)
+		}
+		o.Merge(flags, config)
+	}
+	if err := o.Validate(); err != nil {
+		return fmt.Errorf("failed to validate agent options: %v", err)
+	}
+	o.Print()
+
+	if _, err := o.WatchConfigFile(func(updated *options.GrpcProxyAgentOptions) error {
+		klog.Info("applied hot-reloadable agent configuration (count-server-leases, lease-label, log verbosity); any other changed field requires a restart, see the preceding warning(s)")
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to watch --config %q: %v", o.ConfigPath, err)
+	}
+
+	if err := serveAdmin(o, s.metrics); err != nil {
+		return err
+	}
+
+	clientSetConfig := o.ClientSetConfig()
+	clientSet, err := agent.NewAgentClientSet(clientSetConfig)
+	if err != nil {
+		// NewAgentClientSet reports one aggregate result for the whole
+		// configured endpoint set, not per-endpoint, so DialAttempts only
+		// tracks the overall outcome rather than attributing it to any one
+		// of o.ProxyServerHosts.
+		s.metrics.DialAttempts.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to create agent client set for %v: %v", o.ProxyServerHosts, err)
+	}
+	s.clientSet = clientSet
+	s.metrics.DialAttempts.WithLabelValues("ok").Inc()
+	klog.Infof("dialing %d proxy-server endpoint(s): %v", len(o.ProxyServerHosts), o.ProxyServerHosts)
+	clientSet.Serve()
+
+	if o.CountServerLeases {
+		if err := s.runLeaseDiscovery(stopCh); err != nil {
+			return fmt.Errorf("failed to start lease discovery: %v", err)
+		}
+	}
+
+	<-stopCh
+	return nil
+}
+
+// runLeaseDiscovery builds the kubernetes client used for --count-server-leases
+// (tuned with --kube-api-qps/--kube-api-burst, falling back to in-cluster
+// config when --kubeconfig is unset) and periodically counts matching leases,
+// feeding the result into the agent's server-count tracking. LeaseLabel and
+// CountServerLeases are hot-reloadable via --config, so each tick re-reads
+// them under o.RLock rather than closing over a stale snapshot. Run only calls
+// this when CountServerLeases is true at startup, so enabling it later by
+// reload has no effect until the agent is restarted. The poll
+// interval itself is fixed at startup from SyncInterval, since KubeAPIQPS/
+// KubeAPIBurst are baked into kubeClient and can't be changed without
+// rebuilding it, and SyncInterval already has a documented meaning (the
+// ClientSet's own sync-loop backoff) this poll's cadence merely borrows.
+func (s *AgentServer) runLeaseDiscovery(stopCh <-chan struct{}) error {
+	o := s.o
+	restConfig, err := o.RestConfig()
+	if err != nil {
+		return fmt.Errorf("failed to build kubernetes client config: %v", err)
+	}
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	o.RLock()
+	interval := o.SyncInterval
+	o.RUnlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				o.RLock()
+				enabled := o.CountServerLeases
+				leaseLabel := o.LeaseLabel
+				o.RUnlock()
+
+				if !enabled {
+					klog.V(2).Info("count-server-leases disabled via config reload, skipping this cycle")
+					continue
+				}
+
+				selector, err := util.ParseLabels(leaseLabel)
+				if err != nil {
+					klog.Errorf("invalid --lease-label %q: %v", leaseLabel, err)
+					continue
+				}
+				start := time.Now()
+				count, err := countValidLeases(kubeClient, o.LeaseNamespace, selector.String())
+				s.metrics.LeaseDiscoveryLatency.Observe(time.Since(start).Seconds())
+				if err != nil {
+					klog.Errorf("failed to count server leases in namespace %q: %v", o.LeaseNamespace, err)
+					continue
+				}
+				klog.V(2).Infof("counted %d valid server lease(s) in namespace %q", count, o.LeaseNamespace)
+				s.clientSet.SyncServerCount(count)
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// countValidLeases lists leases matching selector in namespace and counts the
+// ones that haven't expired, i.e. whose renew time plus lease duration is
+// still in the future.
+func countValidLeases(kubeClient kubernetes.Interface, namespace, selector string) (int, error) {
+	leases, err := kubeClient.CoordinationV1().Leases(namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	count := 0
+	for _, lease := range leases.Items {
+		if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+		if now.Before(expiry) {
+			count++
+		}
+	}
+	return count, nil
+}